@@ -45,6 +45,10 @@ import (
     "fmt"
     "flag"
     "sync"
+    "time"
+    "bytes"
+    "strconv"
+    "strings"
     "path/filepath"
     "debug/macho"
     "syscall"
@@ -52,23 +56,65 @@ import (
     "github.com/schollz/progressbar/v3"
     "crypto/sha256"
     "encoding/hex"
+    "encoding/json"
+    "encoding/csv"
+    "encoding/binary"
+    "math"
 )
 
 const (
     // the sample has this specific file size so use it to distinguish from
     // everything else if mixed with others
     fileSize = 172792
+    // defaultDecryptMagic is NOT sourced from the put.as write-up or any
+    // known todecrypt sample layout - it's a guess at the tag bracketing an
+    // embedded EvilQuest blob in __data / __const, seen at both the start
+    // (magic) and the end (end_marker) of the structure. Override it with
+    // -payload-magic once the real value for a given corpus is known.
+    defaultDecryptMagic int64 = 0x4551564C4D47
+    // how many bytes of a clustered __text section to embed in a generated YARA rule
+    yaraPatternBytes = 64
 )
 
 var (
-    totalWork int64
     jobGroup sync.WaitGroup
     mainGroup sync.WaitGroup
-    codeHashes = make(map[string]int)
-    cstringHashes = make(map[string]int)
+    // decryptMagic is a guess by default (see defaultDecryptMagic); -payload-magic
+    // overrides it once the real tag value for a corpus is known.
+    decryptMagic = defaultDecryptMagic
+    // arch -> hash -> count, so clones can be told apart per Mach-O slice
+    codeHashes = make(map[string]map[string]int)
+    cstringHashes = make(map[string]map[string]int)
+    payloadCipherHashes = make(map[string]map[string]int)
+    payloadPlainHashes = make(map[string]map[string]int)
+    // decrypted payload hash -> recovered key / plaintext size, for clustering by key
+    payloadKeys = make(map[string]string)
+    payloadSizes = make(map[string]int)
+    // __text hash -> sample paths that produced it, and a representative copy of
+    // the raw section bytes (first one seen) for YARA rule generation
+    codeHashPaths = make(map[string][]string)
+    codeHashSample = make(map[string][]byte)
+    // __text hash -> size in bytes of the whole file that produced the sample
+    // above, since a YARA rule generated from it needs the real filesize, not
+    // the fixed-size assumption the original single-family tool made
+    codeHashFileSize = make(map[string]int64)
     mapMutex sync.Mutex
     tasks = make(chan string)
     interrupted bool
+
+    // run summary counters, reported in the text and json output
+    filesWalked int64
+    filesParsed int64
+    parseErrors int64
+    statsMutex sync.Mutex
+
+    // set from -o / -format / -min-cluster
+    outputPath string
+    outputFormat string
+    minCluster int
+
+    // set from -rate-bytes; nil means unthrottled
+    ioLimiter *tokenBucket
 )
 
 type todecrypt struct {
@@ -101,141 +147,1113 @@ func get_sha256(buf []byte) string {
     return hash_string
 }
 
+// archKey identifies a Mach-O slice by cpu type and subtype, e.g. "CpuAmd64_3",
+// so hashes from different architectures packed in the same fat file never collide.
+func archKey(cpu macho.Cpu, subcpu uint32) string {
+    return fmt.Sprintf("%s_%d", cpu, subcpu)
+}
+
+func recordHash(store map[string]map[string]int, arch string, hash string) {
+    mapMutex.Lock()
+    defer mapMutex.Unlock()
+    if store[arch] == nil {
+        store[arch] = make(map[string]int)
+    }
+    store[arch][hash]++
+}
+
+// tokenBucket is an I/O throttle: tokens refill linearly at ratePerSecond and
+// are capped at one second's worth, and Read blocks until enough tokens are
+// available to cover the bytes it returned. No moving average of the observed
+// rate is kept, and the refill window is fixed at one second.
+type tokenBucket struct {
+    mu            sync.Mutex
+    ratePerSecond float64
+    tokens        float64
+    last          time.Time
+}
+
+func newTokenBucket(ratePerSecond int64) *tokenBucket {
+    return &tokenBucket{
+        ratePerSecond: float64(ratePerSecond),
+        tokens:        float64(ratePerSecond),
+        last:          time.Now(),
+    }
+}
+
+func (tb *tokenBucket) refillLocked() {
+    now := time.Now()
+    elapsed := now.Sub(tb.last).Seconds()
+    tb.last = now
+    tb.tokens += elapsed * tb.ratePerSecond
+    if tb.tokens > tb.ratePerSecond {
+        tb.tokens = tb.ratePerSecond
+    }
+}
+
+func (tb *tokenBucket) take(n int) {
+    tb.mu.Lock()
+    defer tb.mu.Unlock()
+    tb.refillLocked()
+    for tb.tokens < float64(n) {
+        wait := time.Duration((float64(n)-tb.tokens) / tb.ratePerSecond * float64(time.Second))
+        tb.mu.Unlock()
+        time.Sleep(wait)
+        tb.mu.Lock()
+        tb.refillLocked()
+    }
+    tb.tokens -= float64(n)
+}
+
+type limitedReader struct {
+    r  io.Reader
+    tb *tokenBucket
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+    // the bucket never holds more than ratePerSecond tokens, so a larger read
+    // could never be admitted: split it into reads the bucket can cover
+    if max := int(lr.tb.ratePerSecond); max > 0 && len(p) > max {
+        p = p[:max]
+    }
+    n, err := lr.r.Read(p)
+    if n > 0 {
+        lr.tb.take(n)
+    }
+    return n, err
+}
+
+// sectionReader wraps sec.Open() in the global -rate-bytes limiter, if one is set.
+func sectionReader(sec *macho.Section) io.Reader {
+    var r io.Reader = sec.Open()
+    if ioLimiter != nil {
+        r = &limitedReader{r: r, tb: ioLimiter}
+    }
+    return r
+}
+
+func readSection(machoFile *macho.File, name string) ([]byte, bool) {
+    sec := machoFile.Section(name)
+    if sec == nil {
+        return nil, false
+    }
+    b := make([]byte, sec.Size)
+    if _, err := io.ReadFull(sectionReader(sec), b); err != nil && err != io.ErrUnexpectedEOF {
+        return nil, false
+    }
+    return b, true
+}
+
+func hashSection(machoFile *macho.File, name string) (string, bool) {
+    b, ok := readSection(machoFile, name)
+    if !ok {
+        return "", false
+    }
+    return get_sha256(b), true
+}
+
+// xorDecrypt reverses the sample's repeating-XOR-with-rolling-key routine:
+// plain[i] = cipher[i] ^ key[i % key_len]
+func xorDecrypt(cipher []byte, key []byte) []byte {
+    plain := make([]byte, len(cipher))
+    for i, c := range cipher {
+        plain[i] = c ^ key[i%len(key)]
+    }
+    return plain
+}
+
+// parseBlobAt reads a todecrypt structure starting at buf[start], which must
+// already point at the 8-byte magic. Layout: magic(8) key_len(8) key(N)
+// payload_len(8) payload(M) end_marker(8).
+func parseBlobAt(buf []byte, start int) (todecrypt, int, bool) {
+    pos := start
+    if pos+16 > len(buf) {
+        return todecrypt{}, 0, false
+    }
+    magic := int64(binary.LittleEndian.Uint64(buf[pos : pos+8]))
+    pos += 8
+
+    keyLen := int64(binary.LittleEndian.Uint64(buf[pos : pos+8]))
+    pos += 8
+    if keyLen <= 0 || keyLen > int64(len(buf)-pos) {
+        return todecrypt{}, 0, false
+    }
+    key := string(buf[pos : pos+int(keyLen)])
+    pos += int(keyLen)
+
+    if pos+8 > len(buf) {
+        return todecrypt{}, 0, false
+    }
+    payloadLen := int64(binary.LittleEndian.Uint64(buf[pos : pos+8]))
+    pos += 8
+    if payloadLen <= 0 || payloadLen > int64(len(buf)-pos-8) {
+        return todecrypt{}, 0, false
+    }
+    encrypted := append([]byte(nil), buf[pos:pos+int(payloadLen)]...)
+    pos += int(payloadLen)
+
+    endMarker := int64(binary.LittleEndian.Uint64(buf[pos : pos+8]))
+    pos += 8
+    if endMarker != decryptMagic {
+        return todecrypt{}, 0, false
+    }
+
+    return todecrypt{
+        magic:          magic,
+        key:            key,
+        key_len:        keyLen,
+        encrypted_data: encrypted,
+        encrypted_size: payloadLen,
+        end_marker:     endMarker,
+    }, pos, true
+}
+
+// scanForBlobs walks buf looking for the EvilQuest tagged-blob layout,
+// recovering every todecrypt structure it can parse out of it.
+func scanForBlobs(buf []byte) []todecrypt {
+    magicBytes := make([]byte, 8)
+    binary.LittleEndian.PutUint64(magicBytes, uint64(decryptMagic))
+
+    var blobs []todecrypt
+    offset := 0
+    for {
+        idx := bytes.Index(buf[offset:], magicBytes)
+        if idx < 0 {
+            break
+        }
+        start := offset + idx
+        if blob, next, ok := parseBlobAt(buf, start); ok {
+            blobs = append(blobs, blob)
+            offset = next
+        } else {
+            offset = start + 1
+        }
+    }
+    return blobs
+}
+
+// extractPayloads recovers every tagged EvilQuest blob embedded in the
+// __data / __const sections of machoFile.
+func extractPayloads(machoFile *macho.File) []todecrypt {
+    var blobs []todecrypt
+    for _, name := range []string{"__data", "__const"} {
+        sec := machoFile.Section(name)
+        if sec == nil {
+            continue
+        }
+        buf := make([]byte, sec.Size)
+        if _, err := io.ReadFull(sectionReader(sec), buf); err != nil && err != io.ErrUnexpectedEOF {
+            continue
+        }
+        blobs = append(blobs, scanForBlobs(buf)...)
+    }
+    return blobs
+}
+
+func recordPayload(arch string, blob todecrypt) {
+    plain := xorDecrypt(blob.encrypted_data, []byte(blob.key))
+    cipherHash := get_sha256(blob.encrypted_data)
+    plainHash := get_sha256(plain)
+
+    recordHash(payloadCipherHashes, arch, cipherHash)
+    recordHash(payloadPlainHashes, arch, plainHash)
+
+    mapMutex.Lock()
+    payloadKeys[plainHash] = blob.key
+    payloadSizes[plainHash] = len(plain)
+    mapMutex.Unlock()
+}
+
+func analyseArch(path string, fileSize int64, arch string, machoFile *macho.File) {
+    if b, ok := readSection(machoFile, "__text"); ok {
+        hash := get_sha256(b)
+        recordHash(codeHashes, arch, hash)
+
+        mapMutex.Lock()
+        if _, seen := codeHashSample[hash]; !seen {
+            codeHashSample[hash] = append([]byte(nil), b...)
+            codeHashFileSize[hash] = fileSize
+        }
+        codeHashPaths[hash] = append(codeHashPaths[hash], path)
+        mapMutex.Unlock()
+    }
+
+    if hash, ok := hashSection(machoFile, "__cstring"); ok {
+        recordHash(cstringHashes, arch, hash)
+        // fmt.Printf("%s -> %s\n", path, hash)
+    }
+
+    for _, blob := range extractPayloads(machoFile) {
+        recordPayload(arch, blob)
+    }
+}
+
 func analyseBinary(path string) {
+    statsMutex.Lock()
+    filesWalked++
+    statsMutex.Unlock()
+
     r, err := os.Open(path)
     if err != nil {
         fmt.Printf("[-] ERROR: %s @ %s\n", err.Error(), path)
+        statsMutex.Lock()
+        parseErrors++
+        statsMutex.Unlock()
         return
     }
-
     defer r.Close()
+
+    var fileSize int64
+    if info, err := r.Stat(); err == nil {
+        fileSize = info.Size()
+    }
+
+    if fatFile, err := macho.NewFatFile(r); err == nil {
+        defer fatFile.Close()
+        for _, a := range fatFile.Arches {
+            analyseArch(path, fileSize, archKey(a.Cpu, a.SubCpu), a.File)
+        }
+        statsMutex.Lock()
+        filesParsed++
+        statsMutex.Unlock()
+        return
+    }
+
+    if _, err := r.Seek(0, io.SeekStart); err != nil {
+        statsMutex.Lock()
+        parseErrors++
+        statsMutex.Unlock()
+        return
+    }
     machoFile, err := macho.NewFile(r)
-    // maybe fat
     if err != nil {
+        statsMutex.Lock()
+        parseErrors++
+        statsMutex.Unlock()
         return
-    } 
+    }
     defer machoFile.Close()
-    sec := machoFile.Section("__text")
-    if sec != nil {
-        b := make([]byte, sec.Size)
-        r := sec.Open()
-        if _, err := r.Read(b); err != nil {
-            return
+    analyseArch(path, fileSize, archKey(machoFile.Cpu, machoFile.SubCpu), machoFile)
+    statsMutex.Lock()
+    filesParsed++
+    statsMutex.Unlock()
+}
+
+// Matcher decides whether a given file should be analysed. header holds the
+// first few bytes of the file, read once by the walker and shared across all
+// configured matchers so multiple sniffers don't each reopen the file.
+type Matcher interface {
+    Match(path string, info os.FileInfo, header []byte) bool
+}
+
+// sizeMatcher reproduces the tool's original behaviour: match an exact file size.
+type sizeMatcher struct {
+    size int64
+}
+
+func (m sizeMatcher) Match(path string, info os.FileInfo, header []byte) bool {
+    return info.Size() == m.size
+}
+
+// sizeRangeMatcher matches files whose size falls within [min, max].
+type sizeRangeMatcher struct {
+    min, max int64
+}
+
+func (m sizeRangeMatcher) Match(path string, info os.FileInfo, header []byte) bool {
+    return info.Size() >= m.min && info.Size() <= m.max
+}
+
+// isMachOMagic checks header against MH_MAGIC/MH_MAGIC_64/FAT_MAGIC and their
+// byte-swapped (_CIGAM) counterparts, the same way debug/macho itself does.
+func isMachOMagic(header []byte) bool {
+    if len(header) < 4 {
+        return false
+    }
+    be := binary.BigEndian.Uint32(header[0:4])
+    le := binary.LittleEndian.Uint32(header[0:4])
+    if be == macho.MagicFat || le == macho.MagicFat {
+        return true
+    }
+    return be&^1 == macho.Magic32&^1 || le&^1 == macho.Magic32&^1
+}
+
+// machoMagicMatcher matches any thin or fat Mach-O, regardless of size.
+type machoMagicMatcher struct{}
+
+func (machoMagicMatcher) Match(path string, info os.FileInfo, header []byte) bool {
+    return isMachOMagic(header)
+}
+
+// lcCodeSignature is LC_CODE_SIGNATURE; debug/macho doesn't export it since it
+// never interprets the command itself, it just keeps the raw bytes around.
+const lcCodeSignature macho.LoadCmd = 0x1d
+
+const (
+    csMagicEmbeddedSignature uint32 = 0xfade0cc0
+    csMagicCodeDirectory     uint32 = 0xfade0c02
+    csSlotCodeDirectory      uint32 = 0
+    // teamOffset was added to CS_CodeDirectory in this version
+    csCodeDirectoryTeamIDVersion uint32 = 0x20200
+)
+
+// codeDirectoryTeamID extracts the Team ID from a CS_CodeDirectory blob found
+// inside buf (a CS_SuperBlob read from the LC_CODE_SIGNATURE data region).
+// The code signing structures are big-endian regardless of the binary's own
+// byte order.
+func codeDirectoryTeamID(buf []byte) (string, bool) {
+    if len(buf) < 12 || binary.BigEndian.Uint32(buf[0:4]) != csMagicEmbeddedSignature {
+        return "", false
+    }
+    count := binary.BigEndian.Uint32(buf[8:12])
+    for i := uint32(0); i < count; i++ {
+        idxOff := 12 + i*8
+        if int(idxOff+8) > len(buf) {
+            break
         }
-        hash := get_sha256(b)
-        // maps are not thread safe
-        mapMutex.Lock()
-        codeHashes[hash]++
-        mapMutex.Unlock()
+        slotType := binary.BigEndian.Uint32(buf[idxOff : idxOff+4])
+        slotOffset := binary.BigEndian.Uint32(buf[idxOff+4 : idxOff+8])
+        if slotType != csSlotCodeDirectory || int(slotOffset) >= len(buf) {
+            continue
+        }
+
+        cd := buf[slotOffset:]
+        if len(cd) < 52 || binary.BigEndian.Uint32(cd[0:4]) != csMagicCodeDirectory {
+            continue
+        }
+        version := binary.BigEndian.Uint32(cd[8:12])
+        if version < csCodeDirectoryTeamIDVersion {
+            continue
+        }
+        teamOffset := binary.BigEndian.Uint32(cd[48:52])
+        if int(teamOffset) >= len(cd) {
+            continue
+        }
+        teamBytes := cd[teamOffset:]
+        end := bytes.IndexByte(teamBytes, 0)
+        if end < 0 {
+            end = len(teamBytes)
+        }
+        return string(teamBytes[:end]), true
     }
+    return "", false
+}
 
-    sec = machoFile.Section("__cstring")
-    if sec != nil {
-        b := make([]byte, sec.Size)
-        r := sec.Open()
-        if _, err := r.Read(b); err != nil {
-            return
+// machoTeamID reads the LC_CODE_SIGNATURE blob of machoFile, based at fileBase
+// (non-zero for a slice embedded in a fat file), and returns its Team ID.
+func machoTeamID(r io.ReaderAt, fileBase int64, machoFile *macho.File) (string, bool) {
+    for _, l := range machoFile.Loads {
+        raw := l.Raw()
+        if len(raw) < 16 || macho.LoadCmd(machoFile.ByteOrder.Uint32(raw[0:4])) != lcCodeSignature {
+            continue
         }
-        hash := get_sha256(b)
-        // maps are not thread safe
-        mapMutex.Lock()
-        cstringHashes[hash]++
-        mapMutex.Unlock()
-        // fmt.Printf("%s -> %s\n", path, hash)
+        dataOff := machoFile.ByteOrder.Uint32(raw[8:12])
+        dataSize := machoFile.ByteOrder.Uint32(raw[12:16])
+        buf := make([]byte, dataSize)
+        if _, err := r.ReadAt(buf, fileBase+int64(dataOff)); err != nil {
+            return "", false
+        }
+        return codeDirectoryTeamID(buf)
     }
+    return "", false
+}
 
+// teamIDMatcher matches Mach-O files code-signed with the given Team ID.
+type teamIDMatcher struct {
+    teamID string
 }
 
-func analyseFolder(input_folder string, jobs int) {
-    var err error
+func (m teamIDMatcher) Match(path string, info os.FileInfo, header []byte) bool {
+    f, err := os.Open(path)
+    if err != nil {
+        return false
+    }
+    defer f.Close()
 
-    // find out the total amount of work
-    fmt.Printf("[+] Counting number of files to analyse...")
-    err = filepath.Walk(input_folder, func(path string, info os.FileInfo, err error) error {
-        if err != nil {
-            return nil
+    if fatFile, err := macho.NewFatFile(f); err == nil {
+        defer fatFile.Close()
+        for _, a := range fatFile.Arches {
+            if id, ok := machoTeamID(f, int64(a.Offset), a.File); ok && id == m.teamID {
+                return true
+            }
+        }
+        return false
+    }
+
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return false
+    }
+    machoFile, err := macho.NewFile(f)
+    if err != nil {
+        return false
+    }
+    defer machoFile.Close()
+    id, ok := machoTeamID(f, 0, machoFile)
+    return ok && id == m.teamID
+}
+
+// yaraRule is a deliberately small subset of a real YARA rule: plain and hex
+// strings plus an "any of them" / "all of them" condition. It exists so the
+// tool can be repurposed with a rule file instead of a recompile, without
+// pulling in a cgo dependency on libyara.
+type yaraRule struct {
+    name     string
+    strings  map[string][]byte
+    matchAll bool
+}
+
+func parseYaraHexString(s string) ([]byte, error) {
+    s = strings.Map(func(r rune) rune {
+        if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+            return -1
+        }
+        return r
+    }, s)
+    return hex.DecodeString(s)
+}
+
+// parseYaraRules parses a small subset of YARA syntax:
+//
+//	rule name
+//	{
+//	    strings:
+//	        $a = "text"
+//	        $b = { AA BB CC }
+//	    condition:
+//	        any of them
+//	}
+func parseYaraRules(path string) ([]yaraRule, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var rules []yaraRule
+    var current *yaraRule
+    inStrings := false
+
+    for _, line := range strings.Split(string(data), "\n") {
+        trimmed := strings.TrimSpace(line)
+        switch {
+        case strings.HasPrefix(trimmed, "rule "):
+            // the opening brace may share the line with the name ("rule foo {"),
+            // so strip it from the whole line before splitting into fields.
+            fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(trimmed), "{"))
+            name := fields[len(fields)-1]
+            rules = append(rules, yaraRule{name: name, strings: make(map[string][]byte)})
+            current = &rules[len(rules)-1]
+            inStrings = false
+        case trimmed == "strings:":
+            inStrings = true
+        case trimmed == "condition:":
+            inStrings = false
+        case strings.HasPrefix(trimmed, "any of them"):
+            if current != nil {
+                current.matchAll = false
+            }
+        case strings.HasPrefix(trimmed, "all of them"):
+            if current != nil {
+                current.matchAll = true
+            }
+        case inStrings && strings.HasPrefix(trimmed, "$"):
+            parts := strings.SplitN(trimmed, "=", 2)
+            if len(parts) != 2 || current == nil {
+                continue
+            }
+            id := strings.TrimSpace(parts[0])
+            value := strings.TrimSpace(parts[1])
+            switch {
+            case strings.HasPrefix(value, "\""):
+                current.strings[id] = []byte(strings.Trim(value, "\""))
+            case strings.HasPrefix(value, "{"):
+                pattern, err := parseYaraHexString(strings.Trim(strings.TrimSpace(strings.Trim(value, "{}")), " "))
+                if err == nil {
+                    current.strings[id] = pattern
+                }
+            }
+        }
+    }
+    return rules, nil
+}
+
+type yaraMatcher struct {
+    rules []yaraRule
+}
+
+func newYaraMatcher(path string) (*yaraMatcher, error) {
+    rules, err := parseYaraRules(path)
+    if err != nil {
+        return nil, err
+    }
+    return &yaraMatcher{rules: rules}, nil
+}
+
+func (m *yaraMatcher) Match(path string, info os.FileInfo, header []byte) bool {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return false
+    }
+    for _, rule := range m.rules {
+        matched := 0
+        for _, pattern := range rule.strings {
+            if len(pattern) > 0 && bytes.Contains(data, pattern) {
+                matched++
+            }
+        }
+        if rule.matchAll {
+            if matched == len(rule.strings) && len(rule.strings) > 0 {
+                return true
+            }
+        } else if matched > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// matcherSet combines several matchers with -match any|all semantics.
+type matcherSet struct {
+    matchers []Matcher
+    matchAll bool
+}
+
+func (s matcherSet) Match(path string, info os.FileInfo, header []byte) bool {
+    if len(s.matchers) == 0 {
+        return false
+    }
+    for _, m := range s.matchers {
+        matched := m.Match(path, info, header)
+        if s.matchAll && !matched {
+            return false
         }
-        if info.Mode().IsRegular() && info.Size() == fileSize {
-            totalWork++
+        if !s.matchAll && matched {
+            return true
         }
+    }
+    return s.matchAll
+}
+
+// readHeader reads the first few bytes of path for the magic-sniffing matchers.
+func readHeader(path string) []byte {
+    f, err := os.Open(path)
+    if err != nil {
         return nil
-    })
+    }
+    defer f.Close()
+    buf := make([]byte, 8)
+    n, _ := io.ReadFull(f, buf)
+    return buf[:n]
+}
+
+// checkpointData is the on-disk shape of a -resume checkpoint: the set of
+// already-processed paths plus the hash maps accumulated so far, so a resumed
+// run merges counts instead of recomputing them.
+type checkpointData struct {
+    Processed           []string                  `json:"processed"`
+    CodeHashes          map[string]map[string]int `json:"code_hashes"`
+    CStringHashes       map[string]map[string]int `json:"cstring_hashes"`
+    PayloadCipherHashes map[string]map[string]int `json:"payload_cipher_hashes"`
+    PayloadPlainHashes  map[string]map[string]int `json:"payload_plain_hashes"`
+    PayloadKeys         map[string]string         `json:"payload_keys"`
+    PayloadSizes        map[string]int            `json:"payload_sizes"`
+    CodeHashPaths       map[string][]string       `json:"code_hash_paths"`
+}
+
+func mergeCounts(dst, src map[string]map[string]int) {
+    for arch, hashes := range src {
+        if dst[arch] == nil {
+            dst[arch] = make(map[string]int)
+        }
+        for hash, count := range hashes {
+            dst[arch][hash] += count
+        }
+    }
+}
+
+// cloneNestedCounts deep-copies a map[string]map[string]int, since checkpoints
+// must not hold references into maps that workers keep mutating.
+func cloneNestedCounts(src map[string]map[string]int) map[string]map[string]int {
+    dst := make(map[string]map[string]int, len(src))
+    for arch, hashes := range src {
+        inner := make(map[string]int, len(hashes))
+        for hash, count := range hashes {
+            inner[hash] = count
+        }
+        dst[arch] = inner
+    }
+    return dst
+}
+
+func cloneStringMap(src map[string]string) map[string]string {
+    dst := make(map[string]string, len(src))
+    for k, v := range src {
+        dst[k] = v
+    }
+    return dst
+}
+
+func cloneIntMap(src map[string]int) map[string]int {
+    dst := make(map[string]int, len(src))
+    for k, v := range src {
+        dst[k] = v
+    }
+    return dst
+}
+
+func cloneStringSliceMap(src map[string][]string) map[string][]string {
+    dst := make(map[string][]string, len(src))
+    for k, v := range src {
+        dst[k] = append([]string(nil), v...)
+    }
+    return dst
+}
+
+// Scanner owns a single streaming walk over a folder: a bounded work queue so
+// huge corpora don't need an eager pre-count, an optional I/O rate limit, and
+// periodic checkpointing so a run can be resumed instead of restarted.
+type Scanner struct {
+    root                string
+    jobs                int
+    matcher             Matcher
+    checkpointPath      string
+    checkpointInterval  time.Duration
+    processed           map[string]bool
+    processedMutex      sync.Mutex
+}
+
+func NewScanner(root string, jobs int, matcher Matcher, checkpointPath string) *Scanner {
+    return &Scanner{
+        root:               root,
+        jobs:               jobs,
+        matcher:            matcher,
+        checkpointPath:     checkpointPath,
+        checkpointInterval: 30 * time.Second,
+        processed:          make(map[string]bool),
+    }
+}
+
+func (s *Scanner) isProcessed(path string) bool {
+    s.processedMutex.Lock()
+    defer s.processedMutex.Unlock()
+    return s.processed[path]
+}
+
+func (s *Scanner) markProcessed(path string) {
+    s.processedMutex.Lock()
+    s.processed[path] = true
+    s.processedMutex.Unlock()
+}
+
+// LoadResume merges a previous checkpoint's hash maps into the running totals
+// and remembers which paths it already covers, so the walk below skips them.
+func (s *Scanner) LoadResume(path string) error {
+    buf, err := os.ReadFile(path)
     if err != nil {
-        fmt.Printf("[-] Error: walking through target folder: %s\n", err.Error())
+        return err
+    }
+    var data checkpointData
+    if err := json.Unmarshal(buf, &data); err != nil {
+        return err
+    }
+
+    mapMutex.Lock()
+    mergeCounts(codeHashes, data.CodeHashes)
+    mergeCounts(cstringHashes, data.CStringHashes)
+    mergeCounts(payloadCipherHashes, data.PayloadCipherHashes)
+    mergeCounts(payloadPlainHashes, data.PayloadPlainHashes)
+    for hash, key := range data.PayloadKeys {
+        payloadKeys[hash] = key
+    }
+    for hash, size := range data.PayloadSizes {
+        payloadSizes[hash] = size
+    }
+    for hash, paths := range data.CodeHashPaths {
+        codeHashPaths[hash] = append(codeHashPaths[hash], paths...)
+    }
+    mapMutex.Unlock()
+
+    s.processedMutex.Lock()
+    for _, p := range data.Processed {
+        s.processed[p] = true
+    }
+    s.processedMutex.Unlock()
+
+    fmt.Printf("[+] Resumed from %s: %d files already processed\n", path, len(data.Processed))
+    return nil
+}
+
+func (s *Scanner) writeCheckpoint() error {
+    s.processedMutex.Lock()
+    processed := make([]string, 0, len(s.processed))
+    for p := range s.processed {
+        processed = append(processed, p)
+    }
+    s.processedMutex.Unlock()
+
+    // deep-copy every map while still holding mapMutex: workers keep calling
+    // recordHash/recordPayload under the same lock while this checkpoint is
+    // marshaled, and json.Marshal iterating a map a worker writes to is a
+    // concurrent map read/write, which is a fatal (unrecoverable) Go runtime error.
+    mapMutex.Lock()
+    data := checkpointData{
+        Processed:           processed,
+        CodeHashes:          cloneNestedCounts(codeHashes),
+        CStringHashes:       cloneNestedCounts(cstringHashes),
+        PayloadCipherHashes: cloneNestedCounts(payloadCipherHashes),
+        PayloadPlainHashes:  cloneNestedCounts(payloadPlainHashes),
+        PayloadKeys:         cloneStringMap(payloadKeys),
+        PayloadSizes:        cloneIntMap(payloadSizes),
+        CodeHashPaths:       cloneStringSliceMap(codeHashPaths),
+    }
+    mapMutex.Unlock()
+
+    buf, err := json.MarshalIndent(data, "", "  ")
+    if err != nil {
+        return err
+    }
+    // write to a temp file first so a crash mid-write can't corrupt the checkpoint
+    tmp := s.checkpointPath + ".tmp"
+    if err := os.WriteFile(tmp, buf, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, s.checkpointPath)
+}
+
+func (s *Scanner) checkpointLoop(done <-chan struct{}) {
+    ticker := time.NewTicker(s.checkpointInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            if err := s.writeCheckpoint(); err != nil {
+                fmt.Printf("[-] ERROR: writing checkpoint: %s\n", err.Error())
+            }
+        case <-done:
+            return
+        }
+    }
+}
+
+func (s *Scanner) analyse(path string, bar *progressbar.ProgressBar) {
+    analyseBinary(path)
+    s.markProcessed(path)
+    bar.Add(1)
+}
+
+// Run performs the single streaming walk: one filepath.Walk feeds a bounded,
+// buffered channel (sized off -n) instead of the old eager-count-then-walk,
+// so memory stays flat no matter how large the corpus is.
+func (s *Scanner) Run(bar *progressbar.ProgressBar) error {
+    jobs := s.jobs
+    if jobs < 1 {
+        jobs = 1
+    }
+    tasks = make(chan string, jobs*4)
+
+    var checkpointDone chan struct{}
+    if s.checkpointPath != "" {
+        checkpointDone = make(chan struct{})
+        go s.checkpointLoop(checkpointDone)
+        defer close(checkpointDone)
     }
 
-    bar := progressbar.Default(totalWork)
-    
     if jobs > 1 {
         jobGroup.Add(jobs)
         for i := 0; i < jobs; i++ {
-            go func(worker int) {
+            go func() {
                 defer jobGroup.Done()
-                for {
-                    path, ok := <- tasks
-                    if !ok {
-                        return
-                    }
-                    analyseBinary(path)
-                    bar.Add(1)
+                for path := range tasks {
+                    s.analyse(path, bar)
                 }
-            }(i)
+            }()
         }
-    } 
+    }
 
-    err = filepath.Walk(input_folder, func(path string, info os.FileInfo, err error) error {
+    err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
         if err != nil {
             return nil
         }
-        if interrupted == true {
+        if interrupted {
             return io.EOF
         }
+        if !info.Mode().IsRegular() {
+            return nil
+        }
+        if s.isProcessed(path) {
+            return nil
+        }
+        if !s.matcher.Match(path, info, readHeader(path)) {
+            return nil
+        }
 
-        if info.Mode().IsRegular() && info.Size() == fileSize {
-                if jobs > 1 {
-                    tasks <- path
-                } else {
-                    analyseBinary(path)
-                    bar.Add(1)
-                }
+        if jobs > 1 {
+            tasks <- path
+        } else {
+            s.analyse(path, bar)
         }
         return nil
     })
-    
-    // the walk was stopped, the signal handler will wait for any jobs still running
-    // since mainGroup.Done() isn't executed, the main thread will block when we exit this function
-    // otherwise we would have a race since the signal handler is executing in a go routine
+
     if err == io.EOF {
         // "Always close a channel on the producer side"
         close(tasks)
-        return
+        return err
     }
     if err != nil {
         fmt.Printf("[-] Error: walking through target folder: %s\n", err.Error())
-    }    
+    }
 
     if jobs > 1 {
-        // no more tasks
         close(tasks)
-        // wait for go routines with work to finish
         jobGroup.Wait()
     }
+
+    if s.checkpointPath != "" {
+        if err := s.writeCheckpoint(); err != nil {
+            fmt.Printf("[-] ERROR: writing final checkpoint: %s\n", err.Error())
+        }
+    }
+    return nil
+}
+
+func analyseFolder(inputFolder string, jobs int, matcher Matcher, checkpointPath string, resumePath string) {
+    scanner := NewScanner(inputFolder, jobs, matcher, checkpointPath)
+    if resumePath != "" {
+        if err := scanner.LoadResume(resumePath); err != nil {
+            fmt.Printf("[-] ERROR: loading checkpoint %s: %s\n", resumePath, err.Error())
+        }
+    }
+
+    bar := progressbar.Default(-1, "scanning")
+
+    // the walk was stopped, the signal handler will wait for any jobs still running
+    // since mainGroup.Done() isn't executed, the main thread will block when we exit this function
+    // otherwise we would have a race since the signal handler is executing in a go routine
+    if err := scanner.Run(bar); err == io.EOF {
+        return
+    }
     showResults()
     // we are done so main thread can resume execution after this
     // we don't defer because if interrupted we don't want main thread to resume
     mainGroup.Done()
 }
 
+func buildTextReport() []byte {
+    var b strings.Builder
+
+    fmt.Fprintln(&b, "__text map")
+    for arch, hashes := range codeHashes {
+        fmt.Fprintf(&b, "  [%s]\n", arch)
+        for k, v := range hashes {
+            fmt.Fprintln(&b, "   ", k, v)
+        }
+    }
+
+    fmt.Fprintln(&b, "__cstring map")
+    for arch, hashes := range cstringHashes {
+        fmt.Fprintf(&b, "  [%s]\n", arch)
+        for k, v := range hashes {
+            fmt.Fprintln(&b, "   ", k, v)
+        }
+    }
+
+    fmt.Fprintln(&b, "decrypted payload ciphertext map")
+    for arch, hashes := range payloadCipherHashes {
+        fmt.Fprintf(&b, "  [%s]\n", arch)
+        for k, v := range hashes {
+            fmt.Fprintln(&b, "   ", k, v)
+        }
+    }
+
+    fmt.Fprintln(&b, "decrypted payload plaintext map")
+    for arch, hashes := range payloadPlainHashes {
+        fmt.Fprintf(&b, "  [%s]\n", arch)
+        for k, v := range hashes {
+            fmt.Fprintln(&b, "   ", k, v, "key:", payloadKeys[k], "size:", payloadSizes[k])
+        }
+    }
+
+    fmt.Fprintf(&b, "files walked: %d, files parsed: %d, errors: %d\n", filesWalked, filesParsed, parseErrors)
+    return []byte(b.String())
+}
+
+type archResult struct {
+    Text    map[string]int `json:"text,omitempty"`
+    CString map[string]int `json:"cstring,omitempty"`
+}
+
+type runSummary struct {
+    FilesWalked int64 `json:"files_walked"`
+    FilesParsed int64 `json:"files_parsed"`
+    Errors      int64 `json:"errors"`
+}
+
+func buildJSONReport() ([]byte, error) {
+    out := struct {
+        Arch    map[string]archResult `json:"arch"`
+        Paths   map[string][]string  `json:"paths"`
+        Summary runSummary            `json:"summary"`
+    }{
+        Arch:  make(map[string]archResult),
+        Paths: codeHashPaths,
+        Summary: runSummary{
+            FilesWalked: filesWalked,
+            FilesParsed: filesParsed,
+            Errors:      parseErrors,
+        },
+    }
+
+    for arch, hashes := range codeHashes {
+        ar := out.Arch[arch]
+        ar.Text = hashes
+        out.Arch[arch] = ar
+    }
+    for arch, hashes := range cstringHashes {
+        ar := out.Arch[arch]
+        ar.CString = hashes
+        out.Arch[arch] = ar
+    }
+
+    return json.MarshalIndent(out, "", "  ")
+}
+
+func buildCSVReport() ([]byte, error) {
+    var buf bytes.Buffer
+    w := csv.NewWriter(&buf)
+
+    w.Write([]string{"section", "arch", "hash", "count", "paths"})
+    for arch, hashes := range codeHashes {
+        for hash, count := range hashes {
+            w.Write([]string{"__text", arch, hash, strconv.Itoa(count), strings.Join(codeHashPaths[hash], ";")})
+        }
+    }
+    for arch, hashes := range cstringHashes {
+        for hash, count := range hashes {
+            w.Write([]string{"__cstring", arch, hash, strconv.Itoa(count), ""})
+        }
+    }
+
+    w.Flush()
+    if err := w.Error(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func hexSpaced(b []byte) string {
+    parts := make([]string, len(b))
+    for i, c := range b {
+        parts[i] = hex.EncodeToString([]byte{c})
+    }
+    return strings.Join(parts, " ")
+}
+
+// buildYaraReport synthesizes one rule per __text cluster whose sample count
+// is at least -min-cluster, so the tool can hunt for known clones as well as report on them.
+func buildYaraReport() []byte {
+    var b strings.Builder
+    ruleNum := 0
+
+    for arch, hashes := range codeHashes {
+        for hash, count := range hashes {
+            if count < minCluster {
+                continue
+            }
+            sample, ok := codeHashSample[hash]
+            if !ok {
+                continue
+            }
+            n := len(sample)
+            if n > yaraPatternBytes {
+                n = yaraPatternBytes
+            }
+            ruleNum++
+            fmt.Fprintf(&b, "rule evilquest_cluster_%d\n{\n", ruleNum)
+            fmt.Fprintf(&b, "    meta:\n        arch = \"%s\"\n        text_hash = \"%s\"\n        cluster_size = %d\n", arch, hash, count)
+            fmt.Fprintf(&b, "    strings:\n        $a = { %s }\n", hexSpaced(sample[:n]))
+            // size comes from the actual matched sample, not the original
+            // tool's hardcoded single-family fileSize: -macho-magic, -team-id,
+            // -yara, etc. can all select families with a different size.
+            if size, ok := codeHashFileSize[hash]; ok && size > 0 {
+                fmt.Fprintf(&b, "    condition:\n        filesize == %d and $a\n}\n\n", size)
+            } else {
+                fmt.Fprintf(&b, "    condition:\n        $a\n}\n\n")
+            }
+        }
+    }
+    return []byte(b.String())
+}
+
+func writeOutput(data []byte) {
+    if outputPath == "" {
+        fmt.Print(string(data))
+        return
+    }
+    if err := os.WriteFile(outputPath, data, 0644); err != nil {
+        fmt.Printf("[-] ERROR: writing %s: %s\n", outputPath, err.Error())
+    }
+}
+
 func showResults() {
-    fmt.Println("__text map")
-    for k, v := range codeHashes {
-        fmt.Println(k,v)    
+    switch outputFormat {
+    case "json":
+        data, err := buildJSONReport()
+        if err != nil {
+            fmt.Printf("[-] ERROR: building json report: %s\n", err.Error())
+            return
+        }
+        writeOutput(data)
+    case "csv":
+        data, err := buildCSVReport()
+        if err != nil {
+            fmt.Printf("[-] ERROR: building csv report: %s\n", err.Error())
+            return
+        }
+        writeOutput(data)
+    case "yara":
+        writeOutput(buildYaraReport())
+    default:
+        writeOutput(buildTextReport())
     }
+}
 
-    fmt.Println("__cstring map")
-    for k, v := range cstringHashes {
-        fmt.Println(k,v)    
+// buildMatcher assembles a Matcher from the sample-matching flags. With none
+// of them set it falls back to the tool's original behaviour: an exact match
+// on the known EvilQuest sample size.
+func buildMatcher(size int64, sizeMin int64, sizeMax int64, machoMagic bool, teamID string, yaraPath string, matchMode string) (Matcher, error) {
+    var matchers []Matcher
+
+    if size > 0 {
+        matchers = append(matchers, sizeMatcher{size: size})
     }
+    if sizeMin > 0 || sizeMax > 0 {
+        // -size-min and -size-max are each independently optional, but
+        // sizeRangeMatcher.Match always checks both bounds: an unset max
+        // defaults to 0, which would silently require size <= 0 and match
+        // nothing, so default it to "no upper bound" instead.
+        if sizeMax == 0 {
+            sizeMax = math.MaxInt64
+        }
+        matchers = append(matchers, sizeRangeMatcher{min: sizeMin, max: sizeMax})
+    }
+    if machoMagic {
+        matchers = append(matchers, machoMagicMatcher{})
+    }
+    if teamID != "" {
+        matchers = append(matchers, teamIDMatcher{teamID: teamID})
+    }
+    if yaraPath != "" {
+        m, err := newYaraMatcher(yaraPath)
+        if err != nil {
+            return nil, err
+        }
+        matchers = append(matchers, m)
+    }
+
+    if len(matchers) == 0 {
+        return sizeMatcher{size: fileSize}, nil
+    }
+    return matcherSet{matchers: matchers, matchAll: matchMode == "all"}, nil
 }
 
 func main() {
@@ -247,21 +1265,79 @@ func main() {
 
     var input string
     var jobs int
+    var rateBytes int64
+    var checkpointPath string
+    var resumePath string
+    var size int64
+    var sizeMin int64
+    var sizeMax int64
+    var machoMagic bool
+    var teamID string
+    var yaraPath string
+    var matchMode string
+    var payloadMagic string
 
     flag.StringVar(&input, "i", "", "file or folder to analyse")
     flag.IntVar(&jobs, "n", 1, "number of parallel scanners to run (default 1)")
+    flag.StringVar(&outputPath, "o", "", "write results to this path instead of stdout")
+    flag.StringVar(&outputFormat, "format", "text", "output format: text, json, csv or yara")
+    flag.IntVar(&minCluster, "min-cluster", 2, "minimum __text cluster size to emit a yara rule for (format yara only)")
+    flag.Int64Var(&rateBytes, "rate-bytes", 0, "throttle section reads to this many bytes/sec (0 = unlimited)")
+    flag.StringVar(&checkpointPath, "checkpoint", "", "periodically write progress + hash maps to this path")
+    flag.StringVar(&resumePath, "resume", "", "resume from a checkpoint written by -checkpoint, skipping files already processed")
+    flag.Int64Var(&size, "size", 0, "match files with exactly this size")
+    flag.Int64Var(&sizeMin, "size-min", 0, "match files with size >= this, use with -size-max")
+    flag.Int64Var(&sizeMax, "size-max", 0, "match files with size <= this, use with -size-min")
+    flag.BoolVar(&machoMagic, "macho-magic", false, "match any thin or fat Mach-O, regardless of size")
+    flag.StringVar(&teamID, "team-id", "", "match Mach-O files code-signed with this Team ID")
+    flag.StringVar(&yaraPath, "yara", "", "match files against a rules file (small YARA subset: strings + any/all of them)")
+    flag.StringVar(&matchMode, "match", "any", "how to combine multiple matchers: any or all")
+    flag.StringVar(&payloadMagic, "payload-magic", "", "override the guessed todecrypt blob magic/end-marker (decimal or 0x-hex), for corpora where the default doesn't match")
     flag.Parse()
 
+    if payloadMagic != "" {
+        parsed, err := strconv.ParseUint(payloadMagic, 0, 64)
+        if err != nil {
+            fmt.Printf("[-] ERROR: invalid -payload-magic %q: %s\n", payloadMagic, err.Error())
+            os.Exit(1)
+        }
+        decryptMagic = int64(parsed)
+    }
+
+    switch outputFormat {
+    case "text", "json", "csv", "yara":
+    default:
+        fmt.Printf("[-] ERROR: unknown -format %q\n", outputFormat)
+        os.Exit(1)
+    }
+
+    switch matchMode {
+    case "any", "all":
+    default:
+        fmt.Printf("[-] ERROR: unknown -match %q\n", matchMode)
+        os.Exit(1)
+    }
+
     if input == "" {
         fmt.Printf("[-] ERROR: please set a file or folder to analyse\n")
         fmt.Println("Usage:")
         flag.PrintDefaults()
-        os.Exit(1)              
+        os.Exit(1)
+    }
+
+    if rateBytes > 0 {
+        ioLimiter = newTokenBucket(rateBytes)
+    }
+
+    matcher, err := buildMatcher(size, sizeMin, sizeMax, machoMagic, teamID, yaraPath, matchMode)
+    if err != nil {
+        fmt.Printf("[-] ERROR: building matcher: %s\n", err.Error())
+        os.Exit(1)
     }
 
     // the main thread does nothing, just waits for the main job because of possible
     // race condition with the signal handler
     mainGroup.Add(1)
-    go analyseFolder(input, jobs)
+    go analyseFolder(input, jobs, matcher, checkpointPath, resumePath)
     mainGroup.Wait()
 }
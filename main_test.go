@@ -0,0 +1,661 @@
+package main
+
+import (
+    "bytes"
+    "debug/macho"
+    "encoding/binary"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// resetReportState clears every global the json, csv and yara report builders read from, so
+// each report test starts from a clean slate regardless of test order.
+func resetReportState(t *testing.T) {
+    t.Helper()
+    codeHashes = make(map[string]map[string]int)
+    cstringHashes = make(map[string]map[string]int)
+    codeHashPaths = make(map[string][]string)
+    codeHashSample = make(map[string][]byte)
+    codeHashFileSize = make(map[string]int64)
+    filesWalked, filesParsed, parseErrors = 0, 0, 0
+    minCluster = 2
+}
+
+// buildBlob serialises a todecrypt structure the same way the sample format
+// lays it out: magic(8) key_len(8) key(N) payload_len(8) payload(M) end_marker(8).
+func buildBlob(key string, payload []byte) []byte {
+    var b bytes.Buffer
+    u64 := make([]byte, 8)
+
+    binary.LittleEndian.PutUint64(u64, uint64(decryptMagic))
+    b.Write(u64)
+
+    binary.LittleEndian.PutUint64(u64, uint64(len(key)))
+    b.Write(u64)
+    b.WriteString(key)
+
+    binary.LittleEndian.PutUint64(u64, uint64(len(payload)))
+    b.Write(u64)
+    b.Write(payload)
+
+    binary.LittleEndian.PutUint64(u64, uint64(decryptMagic))
+    b.Write(u64)
+
+    return b.Bytes()
+}
+
+func TestXorDecrypt(t *testing.T) {
+    key := []byte("abc")
+    plain := []byte("hello, world!")
+    cipher := make([]byte, len(plain))
+    for i, c := range plain {
+        cipher[i] = c ^ key[i%len(key)]
+    }
+
+    got := xorDecrypt(cipher, key)
+    if !bytes.Equal(got, plain) {
+        t.Fatalf("xorDecrypt(cipher, key) = %q, want %q", got, plain)
+    }
+}
+
+func TestParseBlobAt(t *testing.T) {
+    payload := []byte{0x01, 0x02, 0x03, 0x04}
+    buf := buildBlob("key", payload)
+
+    blob, next, ok := parseBlobAt(buf, 0)
+    if !ok {
+        t.Fatalf("parseBlobAt() ok = false, want true")
+    }
+    if next != len(buf) {
+        t.Errorf("next = %d, want %d", next, len(buf))
+    }
+    if blob.key != "key" {
+        t.Errorf("key = %q, want %q", blob.key, "key")
+    }
+    if blob.key_len != 3 {
+        t.Errorf("key_len = %d, want 3", blob.key_len)
+    }
+    if !bytes.Equal(blob.encrypted_data, payload) {
+        t.Errorf("encrypted_data = %v, want %v", blob.encrypted_data, payload)
+    }
+    if blob.encrypted_size != int64(len(payload)) {
+        t.Errorf("encrypted_size = %d, want %d", blob.encrypted_size, len(payload))
+    }
+}
+
+func TestParseBlobAtTruncated(t *testing.T) {
+    buf := buildBlob("key", []byte{0x01, 0x02, 0x03})
+    if _, _, ok := parseBlobAt(buf[:len(buf)-4], 0); ok {
+        t.Fatalf("parseBlobAt() on a truncated blob returned ok = true, want false")
+    }
+}
+
+func TestScanForBlobsFindsMultiple(t *testing.T) {
+    first := buildBlob("key1", []byte("first payload"))
+    second := buildBlob("longerkey", []byte("second payload, a bit longer"))
+
+    buf := append([]byte{0xde, 0xad, 0xbe, 0xef}, first...)
+    buf = append(buf, 0x00, 0x00, 0x00)
+    buf = append(buf, second...)
+
+    blobs := scanForBlobs(buf)
+    if len(blobs) != 2 {
+        t.Fatalf("scanForBlobs() found %d blobs, want 2", len(blobs))
+    }
+    if blobs[0].key != "key1" || string(blobs[0].encrypted_data) != "first payload" {
+        t.Errorf("blobs[0] = %+v", blobs[0])
+    }
+    if blobs[1].key != "longerkey" || string(blobs[1].encrypted_data) != "second payload, a bit longer" {
+        t.Errorf("blobs[1] = %+v", blobs[1])
+    }
+}
+
+func TestScanForBlobsNoMatch(t *testing.T) {
+    buf := bytes.Repeat([]byte{0x41}, 64)
+    if blobs := scanForBlobs(buf); len(blobs) != 0 {
+        t.Fatalf("scanForBlobs() on data with no magic found %d blobs, want 0", len(blobs))
+    }
+}
+
+func TestBuildJSONReport(t *testing.T) {
+    resetReportState(t)
+    codeHashes["x86_64"] = map[string]int{"deadbeef": 3}
+    cstringHashes["x86_64"] = map[string]int{"cafebabe": 1}
+    codeHashPaths["deadbeef"] = []string{"/tmp/a", "/tmp/b"}
+    filesWalked, filesParsed, parseErrors = 5, 4, 1
+
+    data, err := buildJSONReport()
+    if err != nil {
+        t.Fatalf("buildJSONReport() error = %v", err)
+    }
+
+    var out struct {
+        Arch    map[string]archResult `json:"arch"`
+        Paths   map[string][]string   `json:"paths"`
+        Summary runSummary            `json:"summary"`
+    }
+    if err := json.Unmarshal(data, &out); err != nil {
+        t.Fatalf("json.Unmarshal() error = %v", err)
+    }
+
+    if out.Arch["x86_64"].Text["deadbeef"] != 3 {
+        t.Errorf("Arch[x86_64].Text[deadbeef] = %d, want 3", out.Arch["x86_64"].Text["deadbeef"])
+    }
+    if out.Arch["x86_64"].CString["cafebabe"] != 1 {
+        t.Errorf("Arch[x86_64].CString[cafebabe] = %d, want 1", out.Arch["x86_64"].CString["cafebabe"])
+    }
+    if len(out.Paths["deadbeef"]) != 2 {
+        t.Errorf("Paths[deadbeef] = %v, want 2 entries", out.Paths["deadbeef"])
+    }
+    if out.Summary != (runSummary{FilesWalked: 5, FilesParsed: 4, Errors: 1}) {
+        t.Errorf("Summary = %+v, want {5 4 1}", out.Summary)
+    }
+}
+
+func TestBuildCSVReport(t *testing.T) {
+    resetReportState(t)
+    codeHashes["x86_64"] = map[string]int{"deadbeef": 2}
+    codeHashPaths["deadbeef"] = []string{"/tmp/a", "/tmp/b"}
+    cstringHashes["x86_64"] = map[string]int{"cafebabe": 1}
+
+    data, err := buildCSVReport()
+    if err != nil {
+        t.Fatalf("buildCSVReport() error = %v", err)
+    }
+
+    out := string(data)
+    if !strings.Contains(out, "__text,x86_64,deadbeef,2,/tmp/a;/tmp/b") {
+        t.Errorf("CSV missing __text row, got:\n%s", out)
+    }
+    if !strings.Contains(out, "__cstring,x86_64,cafebabe,1,") {
+        t.Errorf("CSV missing __cstring row, got:\n%s", out)
+    }
+}
+
+func TestBuildYaraReport(t *testing.T) {
+    resetReportState(t)
+    codeHashes["x86_64"] = map[string]int{"deadbeef": 3, "belowthreshold": 1}
+    codeHashSample["deadbeef"] = []byte{0xde, 0xad, 0xbe, 0xef}
+    codeHashFileSize["deadbeef"] = 172792
+    codeHashSample["belowthreshold"] = []byte{0x01}
+    minCluster = 2
+
+    out := string(buildYaraReport())
+
+    if !strings.Contains(out, "rule evilquest_cluster_1") {
+        t.Errorf("YARA report missing generated rule, got:\n%s", out)
+    }
+    if !strings.Contains(out, "de ad be ef") {
+        t.Errorf("YARA report missing hex pattern, got:\n%s", out)
+    }
+    if !strings.Contains(out, "filesize == 172792") {
+        t.Errorf("YARA report missing the matched sample's real filesize, got:\n%s", out)
+    }
+    if strings.Contains(out, "belowthreshold") {
+        t.Errorf("YARA report should skip clusters below minCluster, got:\n%s", out)
+    }
+}
+
+func TestTokenBucketRefillCapped(t *testing.T) {
+    tb := &tokenBucket{ratePerSecond: 10, tokens: 0, last: time.Now().Add(-5 * time.Second)}
+    tb.refillLocked()
+    if tb.tokens != 10 {
+        t.Errorf("tokens = %v, want 10 (capped at ratePerSecond)", tb.tokens)
+    }
+}
+
+func TestTokenBucketRefillPartial(t *testing.T) {
+    tb := &tokenBucket{ratePerSecond: 10, tokens: 0, last: time.Now().Add(-500 * time.Millisecond)}
+    tb.refillLocked()
+    if tb.tokens < 4 || tb.tokens > 6 {
+        t.Errorf("tokens = %v, want ~5 after 500ms at 10/s", tb.tokens)
+    }
+}
+
+func TestTokenBucketTakeConsumesWithoutBlocking(t *testing.T) {
+    tb := newTokenBucket(1000)
+    start := time.Now()
+    tb.take(100)
+    if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+        t.Errorf("take() within budget took %v, want no blocking", elapsed)
+    }
+    if tb.tokens > 900 || tb.tokens < 850 {
+        t.Errorf("tokens after take(100) = %v, want ~900", tb.tokens)
+    }
+}
+
+func TestMergeCounts(t *testing.T) {
+    dst := map[string]map[string]int{
+        "x86_64": {"deadbeef": 2},
+    }
+    src := map[string]map[string]int{
+        "x86_64": {"deadbeef": 1, "cafebabe": 5},
+        "arm64":  {"f00dface": 3},
+    }
+
+    mergeCounts(dst, src)
+
+    if dst["x86_64"]["deadbeef"] != 3 {
+        t.Errorf("dst[x86_64][deadbeef] = %d, want 3", dst["x86_64"]["deadbeef"])
+    }
+    if dst["x86_64"]["cafebabe"] != 5 {
+        t.Errorf("dst[x86_64][cafebabe] = %d, want 5", dst["x86_64"]["cafebabe"])
+    }
+    if dst["arm64"]["f00dface"] != 3 {
+        t.Errorf("dst[arm64][f00dface] = %d, want 3", dst["arm64"]["f00dface"])
+    }
+}
+
+func TestCloneHelpersAreIndependentOfSource(t *testing.T) {
+    nested := map[string]map[string]int{"x86_64": {"deadbeef": 1}}
+    nestedClone := cloneNestedCounts(nested)
+    nestedClone["x86_64"]["deadbeef"] = 99
+    if nested["x86_64"]["deadbeef"] != 1 {
+        t.Errorf("cloneNestedCounts did not deep-copy inner map: source mutated to %d", nested["x86_64"]["deadbeef"])
+    }
+
+    strs := map[string]string{"a": "b"}
+    strsClone := cloneStringMap(strs)
+    strsClone["a"] = "mutated"
+    if strs["a"] != "b" {
+        t.Errorf("cloneStringMap shared storage with source: got %q", strs["a"])
+    }
+
+    ints := map[string]int{"a": 1}
+    intsClone := cloneIntMap(ints)
+    intsClone["a"] = 99
+    if ints["a"] != 1 {
+        t.Errorf("cloneIntMap shared storage with source: got %d", ints["a"])
+    }
+
+    slices := map[string][]string{"a": {"x", "y"}}
+    slicesClone := cloneStringSliceMap(slices)
+    slicesClone["a"][0] = "mutated"
+    if slices["a"][0] != "x" {
+        t.Errorf("cloneStringSliceMap shared backing array with source: got %q", slices["a"][0])
+    }
+}
+
+const yaraTestRules = `
+rule any_of_them
+{
+    strings:
+        $a = "needle"
+        $b = { DE AD BE EF }
+    condition:
+        any of them
+}
+rule all_of_them
+{
+    strings:
+        $a = "foo"
+        $b = "bar"
+    condition:
+        all of them
+}
+`
+
+func TestParseYaraRules(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "rules.yar")
+    if err := os.WriteFile(path, []byte(yaraTestRules), 0644); err != nil {
+        t.Fatalf("os.WriteFile() error = %v", err)
+    }
+
+    rules, err := parseYaraRules(path)
+    if err != nil {
+        t.Fatalf("parseYaraRules() error = %v", err)
+    }
+    if len(rules) != 2 {
+        t.Fatalf("parseYaraRules() returned %d rules, want 2", len(rules))
+    }
+
+    any := rules[0]
+    if any.name != "any_of_them" || any.matchAll {
+        t.Errorf("rules[0] = %+v, want any_of_them/matchAll=false", any)
+    }
+    if string(any.strings["$a"]) != "needle" {
+        t.Errorf("rules[0].strings[$a] = %q, want %q", any.strings["$a"], "needle")
+    }
+    if !bytes.Equal(any.strings["$b"], []byte{0xde, 0xad, 0xbe, 0xef}) {
+        t.Errorf("rules[0].strings[$b] = %x, want deadbeef", any.strings["$b"])
+    }
+
+    all := rules[1]
+    if all.name != "all_of_them" || !all.matchAll {
+        t.Errorf("rules[1] = %+v, want all_of_them/matchAll=true", all)
+    }
+}
+
+func TestParseYaraRulesBraceOnNameLine(t *testing.T) {
+    const oneLineBrace = `
+rule myrule {
+    strings:
+        $a = "needle"
+    condition:
+        any of them
+}
+`
+    path := filepath.Join(t.TempDir(), "rules.yar")
+    if err := os.WriteFile(path, []byte(oneLineBrace), 0644); err != nil {
+        t.Fatalf("os.WriteFile() error = %v", err)
+    }
+
+    rules, err := parseYaraRules(path)
+    if err != nil {
+        t.Fatalf("parseYaraRules() error = %v", err)
+    }
+    if len(rules) != 1 {
+        t.Fatalf("parseYaraRules() returned %d rules, want 1", len(rules))
+    }
+    if rules[0].name != "myrule" {
+        t.Errorf("rules[0].name = %q, want %q", rules[0].name, "myrule")
+    }
+}
+
+func TestYaraMatcherAnyVsAll(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "rules.yar")
+    if err := os.WriteFile(path, []byte(yaraTestRules), 0644); err != nil {
+        t.Fatalf("os.WriteFile() error = %v", err)
+    }
+    m, err := newYaraMatcher(path)
+    if err != nil {
+        t.Fatalf("newYaraMatcher() error = %v", err)
+    }
+
+    onlyNeedle := filepath.Join(t.TempDir(), "sample1")
+    os.WriteFile(onlyNeedle, []byte("a needle in a haystack"), 0644)
+    if !m.Match(onlyNeedle, nil, nil) {
+        t.Errorf("Match() = false for a file containing only $a of an any-of-them rule, want true")
+    }
+
+    onlyFoo := filepath.Join(t.TempDir(), "sample2")
+    os.WriteFile(onlyFoo, []byte("foo without the other string"), 0644)
+    if m.Match(onlyFoo, nil, nil) {
+        t.Errorf("Match() = true for a file missing one string required by an all-of-them rule, want false")
+    }
+
+    fooAndBar := filepath.Join(t.TempDir(), "sample3")
+    os.WriteFile(fooAndBar, []byte("foo and bar together"), 0644)
+    if !m.Match(fooAndBar, nil, nil) {
+        t.Errorf("Match() = false for a file containing every string of an all-of-them rule, want true")
+    }
+
+    nothing := filepath.Join(t.TempDir(), "sample4")
+    os.WriteFile(nothing, []byte("nothing of interest"), 0644)
+    if m.Match(nothing, nil, nil) {
+        t.Errorf("Match() = true for a file matching neither rule, want false")
+    }
+}
+
+// buildCodeDirectorySuperBlob constructs a minimal CS_SuperBlob containing a
+// single CS_CodeDirectory blob with the given Team ID, following the same
+// big-endian layout codeDirectoryTeamID parses.
+func buildCodeDirectorySuperBlob(teamID string) []byte {
+    const teamOffset = 52
+    cd := make([]byte, teamOffset+len(teamID)+1)
+    binary.BigEndian.PutUint32(cd[0:4], csMagicCodeDirectory)
+    binary.BigEndian.PutUint32(cd[8:12], csCodeDirectoryTeamIDVersion)
+    binary.BigEndian.PutUint32(cd[48:52], teamOffset)
+    copy(cd[teamOffset:], teamID)
+
+    const slotOffset = 20
+    buf := make([]byte, slotOffset+len(cd))
+    binary.BigEndian.PutUint32(buf[0:4], csMagicEmbeddedSignature)
+    binary.BigEndian.PutUint32(buf[4:8], uint32(len(buf)))
+    binary.BigEndian.PutUint32(buf[8:12], 1)
+    binary.BigEndian.PutUint32(buf[12:16], csSlotCodeDirectory)
+    binary.BigEndian.PutUint32(buf[16:20], slotOffset)
+    copy(buf[slotOffset:], cd)
+
+    return buf
+}
+
+func TestCodeDirectoryTeamID(t *testing.T) {
+    buf := buildCodeDirectorySuperBlob("ABCDE12345")
+    id, ok := codeDirectoryTeamID(buf)
+    if !ok {
+        t.Fatalf("codeDirectoryTeamID() ok = false, want true")
+    }
+    if id != "ABCDE12345" {
+        t.Errorf("codeDirectoryTeamID() = %q, want %q", id, "ABCDE12345")
+    }
+}
+
+func TestCodeDirectoryTeamIDWrongMagic(t *testing.T) {
+    buf := make([]byte, 16)
+    if _, ok := codeDirectoryTeamID(buf); ok {
+        t.Fatalf("codeDirectoryTeamID() ok = true for a buffer with no embedded-signature magic, want false")
+    }
+}
+
+func TestCodeDirectoryTeamIDOldVersion(t *testing.T) {
+    buf := buildCodeDirectorySuperBlob("ABCDE12345")
+    // the CD blob starts right after the 20-byte super-blob header; overwrite
+    // its version field with one older than csCodeDirectoryTeamIDVersion, so
+    // no teamOffset field exists on real binaries of this vintage.
+    binary.BigEndian.PutUint32(buf[20+8:20+12], 0x20100)
+    if _, ok := codeDirectoryTeamID(buf); ok {
+        t.Fatalf("codeDirectoryTeamID() ok = true for a pre-teamOffset CodeDirectory version, want false")
+    }
+}
+
+func TestArchKeyDistinctPerCPUAndSubtype(t *testing.T) {
+    amd64 := archKey(macho.CpuAmd64, 3)
+    arm64 := archKey(macho.CpuArm64, 0)
+    if amd64 == arm64 {
+        t.Fatalf("archKey() returned the same key %q for CpuAmd64 and CpuArm64", amd64)
+    }
+
+    // same cpu, different subtype (e.g. two arm64 variants) must also differ,
+    // since that's exactly the fat-slice collision this request exists to avoid.
+    armv8 := archKey(macho.CpuArm64, 0)
+    armv8e := archKey(macho.CpuArm64, 2)
+    if armv8 == armv8e {
+        t.Fatalf("archKey() returned the same key %q for two different subtypes of CpuArm64", armv8)
+    }
+}
+
+func TestRecordHashKeepsArchesSeparate(t *testing.T) {
+    store := make(map[string]map[string]int)
+    amd64 := archKey(macho.CpuAmd64, 3)
+    arm64 := archKey(macho.CpuArm64, 0)
+
+    // the same __text hash recovered from two different fat-file slices must
+    // be counted in its own arch bucket, not merged into one global count.
+    recordHash(store, amd64, "deadbeef")
+    recordHash(store, amd64, "deadbeef")
+    recordHash(store, arm64, "deadbeef")
+
+    if store[amd64]["deadbeef"] != 2 {
+        t.Errorf("store[%s][deadbeef] = %d, want 2", amd64, store[amd64]["deadbeef"])
+    }
+    if store[arm64]["deadbeef"] != 1 {
+        t.Errorf("store[%s][deadbeef] = %d, want 1", arm64, store[arm64]["deadbeef"])
+    }
+    if len(store) != 2 {
+        t.Errorf("store has %d arch buckets, want 2 (got %v)", len(store), store)
+    }
+}
+
+// statFile writes n bytes to a temp file and returns its os.FileInfo, since
+// sizeMatcher/sizeRangeMatcher.Match both take a real os.FileInfo.
+func statFile(t *testing.T, n int) os.FileInfo {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "sample")
+    if err := os.WriteFile(path, make([]byte, n), 0644); err != nil {
+        t.Fatalf("os.WriteFile() error = %v", err)
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatalf("os.Stat() error = %v", err)
+    }
+    return info
+}
+
+func TestSizeMatcher(t *testing.T) {
+    m := sizeMatcher{size: 100}
+    if !m.Match("", statFile(t, 100), nil) {
+        t.Errorf("Match() = false for a file of exactly the matched size, want true")
+    }
+    if m.Match("", statFile(t, 99), nil) {
+        t.Errorf("Match() = true for a file one byte short of the matched size, want false")
+    }
+}
+
+func TestSizeRangeMatcher(t *testing.T) {
+    m := sizeRangeMatcher{min: 100, max: 200}
+    if m.Match("", statFile(t, 99), nil) {
+        t.Errorf("Match() = true for a file below min, want false")
+    }
+    if !m.Match("", statFile(t, 100), nil) {
+        t.Errorf("Match() = false for a file at min, want true")
+    }
+    if !m.Match("", statFile(t, 200), nil) {
+        t.Errorf("Match() = false for a file at max, want true")
+    }
+    if m.Match("", statFile(t, 201), nil) {
+        t.Errorf("Match() = true for a file above max, want false")
+    }
+}
+
+func TestIsMachOMagic(t *testing.T) {
+    cases := []struct {
+        name   string
+        header []byte
+        want   bool
+    }{
+        {"magic32", []byte{0xfe, 0xed, 0xfa, 0xce}, true},
+        {"magic64", []byte{0xfe, 0xed, 0xfa, 0xcf}, true},
+        {"cigam32", []byte{0xce, 0xfa, 0xed, 0xfe}, true},
+        {"fat magic", []byte{0xca, 0xfe, 0xba, 0xbe}, true},
+        {"not mach-o", []byte{0x7f, 0x45, 0x4c, 0x46}, false},
+        {"too short", []byte{0xfe, 0xed}, false},
+    }
+    for _, c := range cases {
+        if got := isMachOMagic(c.header); got != c.want {
+            t.Errorf("isMachOMagic(%s) = %v, want %v", c.name, got, c.want)
+        }
+    }
+}
+
+func TestMachoMagicMatcher(t *testing.T) {
+    m := machoMagicMatcher{}
+    if !m.Match("", nil, []byte{0xfe, 0xed, 0xfa, 0xce}) {
+        t.Errorf("Match() = false for a MH_MAGIC header, want true")
+    }
+    if m.Match("", nil, []byte{0x00, 0x00, 0x00, 0x00}) {
+        t.Errorf("Match() = true for a non-Mach-O header, want false")
+    }
+}
+
+type fixedMatcher bool
+
+func (m fixedMatcher) Match(path string, info os.FileInfo, header []byte) bool {
+    return bool(m)
+}
+
+func TestMatcherSetAnyVsAll(t *testing.T) {
+    trueM, falseM := fixedMatcher(true), fixedMatcher(false)
+
+    any := matcherSet{matchers: []Matcher{trueM, falseM}, matchAll: false}
+    if !any.Match("", nil, nil) {
+        t.Errorf("any-mode Match() = false with one matching matcher, want true")
+    }
+
+    all := matcherSet{matchers: []Matcher{trueM, falseM}, matchAll: true}
+    if all.Match("", nil, nil) {
+        t.Errorf("all-mode Match() = true with one non-matching matcher, want false")
+    }
+
+    allTrue := matcherSet{matchers: []Matcher{trueM, trueM}, matchAll: true}
+    if !allTrue.Match("", nil, nil) {
+        t.Errorf("all-mode Match() = false when every matcher matches, want true")
+    }
+
+    if (matcherSet{matchAll: false}).Match("", nil, nil) {
+        t.Errorf("empty any-mode matcherSet Match() = true, want false")
+    }
+}
+
+func TestBuildMatcherDefaultsToKnownSampleSize(t *testing.T) {
+    m, err := buildMatcher(0, 0, 0, false, "", "", "any")
+    if err != nil {
+        t.Fatalf("buildMatcher() error = %v", err)
+    }
+    sm, ok := m.(sizeMatcher)
+    if !ok || sm.size != fileSize {
+        t.Errorf("buildMatcher() with no flags = %#v, want sizeMatcher{size: %d}", m, fileSize)
+    }
+}
+
+func TestBuildMatcherExactSize(t *testing.T) {
+    m, err := buildMatcher(12345, 0, 0, false, "", "", "any")
+    if err != nil {
+        t.Fatalf("buildMatcher() error = %v", err)
+    }
+    if !m.Match("", statFile(t, 12345), nil) {
+        t.Errorf("Match() = false for a file matching -size, want true")
+    }
+    if m.Match("", statFile(t, 12346), nil) {
+        t.Errorf("Match() = true for a file not matching -size, want false")
+    }
+}
+
+func TestBuildMatcherSizeMinWithoutMax(t *testing.T) {
+    // regression test for cb9da42: -size-min set without -size-max must not
+    // silently default max to 0 and reject every file.
+    m, err := buildMatcher(0, 1000, 0, false, "", "", "any")
+    if err != nil {
+        t.Fatalf("buildMatcher() error = %v", err)
+    }
+    if !m.Match("", statFile(t, 10_000_000), nil) {
+        t.Errorf("Match() = false for a large file with only -size-min set, want true")
+    }
+    if m.Match("", statFile(t, 999), nil) {
+        t.Errorf("Match() = true for a file below -size-min, want false")
+    }
+}
+
+func TestBuildMatcherSizeRange(t *testing.T) {
+    m, err := buildMatcher(0, 100, 200, false, "", "", "any")
+    if err != nil {
+        t.Fatalf("buildMatcher() error = %v", err)
+    }
+    if !m.Match("", statFile(t, 150), nil) {
+        t.Errorf("Match() = false for a file inside -size-min/-size-max, want true")
+    }
+    if m.Match("", statFile(t, 250), nil) {
+        t.Errorf("Match() = true for a file above -size-max, want false")
+    }
+}
+
+func TestBuildMatcherMachoMagic(t *testing.T) {
+    m, err := buildMatcher(0, 0, 0, true, "", "", "any")
+    if err != nil {
+        t.Fatalf("buildMatcher() error = %v", err)
+    }
+    if !m.Match("", nil, []byte{0xfe, 0xed, 0xfa, 0xce}) {
+        t.Errorf("Match() = false for a Mach-O header with -macho-magic, want true")
+    }
+    if m.Match("", nil, []byte{0x00, 0x00, 0x00, 0x00}) {
+        t.Errorf("Match() = true for a non-Mach-O header with -macho-magic, want false")
+    }
+}
+
+func TestBuildMatcherCombinesWithMatchAll(t *testing.T) {
+    m, err := buildMatcher(0, 100, 200, true, "", "", "all")
+    if err != nil {
+        t.Fatalf("buildMatcher() error = %v", err)
+    }
+    // satisfies the size range but not the macho-magic check
+    if m.Match("", statFile(t, 150), []byte{0x00, 0x00, 0x00, 0x00}) {
+        t.Errorf("Match() = true in -match all mode when only one matcher is satisfied, want false")
+    }
+    if !m.Match("", statFile(t, 150), []byte{0xfe, 0xed, 0xfa, 0xce}) {
+        t.Errorf("Match() = false in -match all mode when every matcher is satisfied, want true")
+    }
+}